@@ -6,6 +6,20 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// layerRequest mirrors RenderLayer for JSON binding, except Opacity is a pointer.
+// This lets the handler tell "client omitted opacity" (nil, defaults to fully
+// opaque) apart from "client explicitly asked for opacity 0" (fully transparent),
+// which the RenderLayer zero value can't express.
+type layerRequest struct {
+	Name           string    `json:"name"`
+	Code           string    `json:"code"`
+	Type           string    `json:"type"`
+	Priority       int       `json:"priority"`
+	BlendMode      BlendMode `json:"blend_mode"`
+	Opacity        *float64  `json:"opacity"`
+	TimeoutSeconds float64   `json:"timeout"`
+}
+
 // setupRouter initializes and configures the Gin router with API endpoints for layer management.
 func setupRouter(p *PipelineManager) *gin.Engine {
 	r := gin.Default()
@@ -25,13 +39,28 @@ func setupRouter(p *PipelineManager) *gin.Engine {
 
 		// POST /api/layers - Adds a new layer or updates an existing one.
 		api.POST("/", func(c *gin.Context) {
-			var layer RenderLayer
-			// Bind JSON request body to the RenderLayer struct
-			if err := c.ShouldBindJSON(&layer); err != nil {
+			var req layerRequest
+			// Bind JSON request body to the layerRequest struct
+			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 
+			layer := RenderLayer{
+				Name:           req.Name,
+				Code:           req.Code,
+				Type:           req.Type,
+				Priority:       req.Priority,
+				BlendMode:      req.BlendMode,
+				TimeoutSeconds: req.TimeoutSeconds,
+			}
+			// Default to fully opaque only when the client omitted opacity entirely.
+			if req.Opacity != nil {
+				layer.Opacity = *req.Opacity
+			} else {
+				layer.Opacity = 1.0
+			}
+
 			// Removed Authentication check as requested.
 
 			if err := p.AddLayer(layer); err != nil {
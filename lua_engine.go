@@ -8,45 +8,162 @@ import (
 	lua "github.com/yuin/gopher-lua"
 )
 
-// BlendMode represents how a layer's output is combined with the existing pixel buffer.
-type BlendMode int
+// BlendMode represents how a layer's rendered output is composited onto the
+// shared pixel buffer. It is modeled as a string so it can be sent and
+// received verbatim through the JSON layer API and from Lua's set_blend_mode.
+type BlendMode string
 
 const (
-	// ModeOverwrite means the layer completely replaces the existing pixel value.
-	ModeOverwrite BlendMode = iota
-	// ModeBase is functionally the same as Overwrite but used for the lowest layer.
-	ModeBase
+	// BlendOverwrite replaces the destination pixel outright, ignoring opacity.
+	BlendOverwrite BlendMode = "OVERWRITE"
+	// BlendBase is functionally the same as Overwrite; AddLayer assigns it to every BASE layer.
+	// It is not restricted to BASE layers: any layer may also select it.
+	BlendBase BlendMode = "BASE"
+	// BlendAdd adds the layer's color to the destination, scaled by opacity.
+	BlendAdd BlendMode = "ADD"
+	// BlendMultiply multiplies the layer's color with the destination, scaled by opacity.
+	BlendMultiply BlendMode = "MULTIPLY"
+	// BlendScreen applies a screen blend (inverse-multiply of inverses), scaled by opacity.
+	BlendScreen BlendMode = "SCREEN"
+	// BlendAlphaOver linearly interpolates the destination towards the layer's color using opacity/per-pixel alpha.
+	BlendAlphaOver BlendMode = "ALPHA_OVER"
+	// BlendMax keeps the brighter of the two colors per channel, scaled by opacity.
+	BlendMax BlendMode = "MAX"
 )
 
-// setupLuaState initializes a Lua environment with custom global functions.
-// It exposes 'get_time', 'get_layer_elapsed_time', 'set_pixel', and 'get_pixel' to the Lua script.
-func setupLuaState(L *lua.LState, pixelBuffer *[]float64, pipelineTime, layerElapsedTime float64) {
+// isValidBlendMode reports whether mode is one of the recognized BlendMode constants.
+func isValidBlendMode(mode BlendMode) bool {
+	switch mode {
+	case BlendOverwrite, BlendBase, BlendAdd, BlendMultiply, BlendScreen, BlendAlphaOver, BlendMax:
+		return true
+	}
+	return false
+}
+
+// unsetAlpha marks a per-pixel alpha slot as "not set by the script", so the
+// compositor falls back to the layer's overall Opacity for that pixel.
+const unsetAlpha = -1.0
+
+// layerRenderResult holds everything a single layer.execute() call produced,
+// ready to be composited into the pipeline's shared pixelBuffer.
+type layerRenderResult struct {
+	// buffer is the layer's private scratch RGB buffer (0-255 scale), length LEDCount*3.
+	buffer []float64
+	// written marks which LEDs this layer actually touched via set_pixel; untouched
+	// LEDs are skipped entirely during compositing instead of contributing black.
+	written []bool
+	// alpha holds an optional per-pixel alpha override (0.0-1.0) set via set_pixel_alpha.
+	// A value of unsetAlpha means "use the layer's Opacity field".
+	alpha []float64
+	// blendMode is the effective blend mode for this frame; starts as layer.BlendMode
+	// but can be changed at runtime by the script via set_blend_mode.
+	blendMode BlendMode
+}
+
+// newLayerRenderResult allocates a zeroed scratch result sized for LEDCount pixels,
+// seeded with the layer's configured blend mode.
+func newLayerRenderResult(blendMode BlendMode) *layerRenderResult {
+	alpha := make([]float64, LEDCount)
+	for i := range alpha {
+		alpha[i] = unsetAlpha
+	}
+	return &layerRenderResult{
+		buffer:    make([]float64, LEDCount*3),
+		written:   make([]bool, LEDCount),
+		alpha:     alpha,
+		blendMode: blendMode,
+	}
+}
+
+// luaFrameContext holds the per-frame inputs/outputs that the Lua API closures
+// read and write through an upvalue. It is allocated once alongside the long-lived
+// *lua.LState and its fields are overwritten before each frame's call, so the
+// closures themselves never need to be re-registered.
+type luaFrameContext struct {
+	readBuffer       []float64
+	result           *layerRenderResult
+	pipelineTime     float64
+	layerElapsedTime float64
+}
+
+// layerLuaState is the long-lived Lua environment owned by a single RenderLayer.
+// It is created once (in AddLayer) instead of per frame: the script is parsed a
+// single time via L.LoadString into fn, and ctx is mutated and fn re-invoked on
+// every frame. The Lua-visible "state" table is set once here, so it persists
+// across frames for scripts to keep animation state in.
+type layerLuaState struct {
+	L   *lua.LState
+	fn  *lua.LFunction
+	ctx *luaFrameContext
+}
+
+// newLayerLuaState creates a persistent Lua environment, registers the host API
+// against ctx, and compiles code into a callable function without running it.
+func newLayerLuaState(code string) (*layerLuaState, error) {
+	L := lua.NewState()
+	ctx := &luaFrameContext{}
+	registerLuaAPI(L, ctx)
+
+	fn, err := L.LoadString(code)
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+
+	// The "state" table is set once: because L outlives any single frame, scripts
+	// can stash values here (particle positions, phase, RNG seed, ...) and read
+	// them back next frame without recomputing everything from get_time().
+	L.SetGlobal("state", L.NewTable())
+
+	return &layerLuaState{L: L, fn: fn, ctx: ctx}, nil
+}
+
+// run invokes the precompiled layer function for one frame with ctx already populated.
+func (ls *layerLuaState) run() error {
+	ls.L.Push(ls.fn)
+	return ls.L.PCall(0, 0, nil)
+}
+
+// Close releases the underlying Lua state. Safe to call on a nil receiver so
+// callers don't need to guard every teardown path.
+func (ls *layerLuaState) Close() {
+	if ls == nil {
+		return
+	}
+	ls.L.Close()
+}
+
+// registerLuaAPI binds 'get_time', 'get_layer_elapsed_time', 'get_pixel', 'set_pixel',
+// 'set_blend_mode' and 'set_pixel_alpha' into L. Every closure reads/writes through ctx
+// (an upvalue), so the same closures keep working frame after frame as ctx's fields are
+// updated in place - only LEDCount and the function values themselves are set once here.
+func registerLuaAPI(L *lua.LState, ctx *luaFrameContext) {
 	L.SetGlobal("LEDCount", lua.LNumber(LEDCount))
 
 	// get_time() returns the current time in seconds since the pipeline started.
 	L.SetGlobal("get_time", L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LNumber(pipelineTime))
+		L.Push(lua.LNumber(ctx.pipelineTime))
 		return 1
 	}))
 
-	// get_layer_elapsed_time() returns the time elapsed in seconds since this layer was added. (New Function)
+	// get_layer_elapsed_time() returns the time elapsed in seconds since this layer was added.
 	L.SetGlobal("get_layer_elapsed_time", L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LNumber(layerElapsedTime))
+		L.Push(lua.LNumber(ctx.layerElapsedTime))
 		return 1
 	}))
 
-	// get_pixel(index) returns the current R, G, B values of a pixel as 0.0-1.0 floats.
-	getPixelFunc := L.NewClosure(func(L *lua.LState) int {
+	// get_pixel(index) returns the composited R, G, B values of a pixel as 0.0-1.0 floats,
+	// as produced by every layer drawn before this one.
+	getPixelFunc := L.NewFunction(func(L *lua.LState) int {
 		index := int(L.CheckNumber(1))
 		// Safety check for LED index
 		if index >= 0 && index < LEDCount {
-			buffer := *pixelBuffer
 			idx := index * 3
 
 			// Scale 0-255 back to 0.0-1.0 float range for Lua
-			L.Push(lua.LNumber(float64(buffer[idx+0]) / 255.0))
-			L.Push(lua.LNumber(float64(buffer[idx+1]) / 255.0))
-			L.Push(lua.LNumber(float64(buffer[idx+2]) / 255.0))
+			L.Push(lua.LNumber(ctx.readBuffer[idx+0] / 255.0))
+			L.Push(lua.LNumber(ctx.readBuffer[idx+1] / 255.0))
+			L.Push(lua.LNumber(ctx.readBuffer[idx+2] / 255.0))
 			return 3
 		}
 		// Return black (0.0, 0.0, 0.0) for out-of-bounds access
@@ -57,9 +174,10 @@ func setupLuaState(L *lua.LState, pixelBuffer *[]float64, pipelineTime, layerEla
 	})
 	L.SetGlobal("get_pixel", getPixelFunc)
 
-	// set_pixel(index, r, g, b) sets the R, G, B values of a pixel.
+	// set_pixel(index, r, g, b) sets the R, G, B values of a pixel in this layer's
+	// scratch buffer and marks it as written so the pipeline composites it.
 	// R, G, B are expected to be 0.0-1.0 floats from the Lua script.
-	setPixelFunc := L.NewClosure(func(L *lua.LState) int {
+	setPixelFunc := L.NewFunction(func(L *lua.LState) int {
 		index := int(L.CheckNumber(1))
 
 		// Check and convert 0.0-1.0 Lua input to 0-255 uint8
@@ -72,20 +190,44 @@ func setupLuaState(L *lua.LState, pixelBuffer *[]float64, pipelineTime, layerEla
 		g := math.Max(0, math.Min(255, gIn*255.0))
 		b := math.Max(0, math.Min(255, bIn*255.0))
 
-		// rFixed, gFixed, bFixed := fixColor(r, g, b)
-
 		if index >= 0 && index < LEDCount {
-			buffer := *pixelBuffer
 			idx := index * 3
 
-			buffer[idx+0] = r
-			buffer[idx+1] = g
-			buffer[idx+2] = b
+			ctx.result.buffer[idx+0] = r
+			ctx.result.buffer[idx+1] = g
+			ctx.result.buffer[idx+2] = b
+			ctx.result.written[index] = true
 		}
 		return 0
 	})
-
 	L.SetGlobal("set_pixel", setPixelFunc)
+
+	// set_pixel_alpha(index, a) overrides the per-pixel alpha (0.0-1.0) used when
+	// compositing this pixel, instead of the layer's overall Opacity. Only takes
+	// effect on pixels also touched by set_pixel.
+	setPixelAlphaFunc := L.NewFunction(func(L *lua.LState) int {
+		index := int(L.CheckNumber(1))
+		a := math.Max(0, math.Min(1, float64(L.CheckNumber(2))))
+
+		if index >= 0 && index < LEDCount {
+			ctx.result.alpha[index] = a
+		}
+		return 0
+	})
+	L.SetGlobal("set_pixel_alpha", setPixelAlphaFunc)
+
+	// set_blend_mode(mode) overrides how this layer's output is composited for the
+	// current frame, e.g. set_blend_mode("ADD").
+	setBlendModeFunc := L.NewFunction(func(L *lua.LState) int {
+		mode := BlendMode(L.CheckString(1))
+		if !isValidBlendMode(mode) {
+			L.ArgError(1, fmt.Sprintf("未知混合模式: %s", mode))
+			return 0
+		}
+		ctx.result.blendMode = mode
+		return 0
+	})
+	L.SetGlobal("set_blend_mode", setBlendModeFunc)
 }
 
 // RenderLayer defines a single script layer in the rendering pipeline.
@@ -98,25 +240,56 @@ type RenderLayer struct {
 	Type string `json:"type"`
 	// Priority dictates the rendering order (lower value draws first).
 	Priority int `json:"priority"`
-	// BlendMode determines how the layer output is applied to the buffer.
-	BlendMode BlendMode `json:"-"`
+	// BlendMode determines how the layer output is composited onto the shared buffer.
+	BlendMode BlendMode `json:"blend_mode"`
+	// Opacity is the default per-pixel alpha (0.0-1.0) used when compositing this
+	// layer, unless a pixel has its own alpha set via set_pixel_alpha.
+	Opacity float64 `json:"opacity"`
 
 	// TimeoutSeconds specifies how long a "TEMPORARY" layer should last before removal.
 	TimeoutSeconds float64 `json:"timeout"`
 	// AddedAt records the time the layer was added for timeout tracking and layer elapsed time calculation.
 	AddedAt time.Time `json:"-"`
+
+	// lua is the layer's long-lived, precompiled Lua environment. It is created by
+	// compileLua when the layer is added and closed when the layer is removed,
+	// updated, or times out - never recreated on a per-frame basis.
+	lua *layerLuaState `json:"-"`
 }
 
-// execute runs the layer's Lua code and applies changes to the pixel buffer.
-// It now accepts pipelineTime (total runtime) and layerElapsedTime (layer-specific runtime).
-func (l *RenderLayer) execute(pixelBuffer *[]float64, pipelineTime, layerElapsedTime float64) error {
-	L := lua.NewState()
-	defer L.Close()
+// compileLua parses l.Code once into a persistent Lua state, replacing any Lua
+// state the layer previously owned. Callers are responsible for closing the
+// layer's old state (if any) themselves once it is safe to do so.
+func (l *RenderLayer) compileLua() error {
+	ls, err := newLayerLuaState(l.Code)
+	if err != nil {
+		return fmt.Errorf("编译 Lua 脚本 '%s' 失败: %w", l.Name, err)
+	}
+	l.lua = ls
+	return nil
+}
+
+// closeLua releases the layer's Lua state, if any. Safe to call multiple times.
+func (l *RenderLayer) closeLua() {
+	l.lua.Close()
+	l.lua = nil
+}
+
+// execute runs the layer's precompiled Lua function against a private scratch
+// buffer and returns the result for the pipeline to composite. readBuffer is the
+// composited state of the pixel buffer as produced by layers drawn earlier in
+// this frame. The layer must have been compiled via compileLua beforehand.
+func (l *RenderLayer) execute(readBuffer []float64, pipelineTime, layerElapsedTime float64) (*layerRenderResult, error) {
+	result := newLayerRenderResult(l.BlendMode)
 
-	setupLuaState(L, pixelBuffer, pipelineTime, layerElapsedTime)
+	ctx := l.lua.ctx
+	ctx.readBuffer = readBuffer
+	ctx.result = result
+	ctx.pipelineTime = pipelineTime
+	ctx.layerElapsedTime = layerElapsedTime
 
-	if err := L.DoString(l.Code); err != nil {
-		return fmt.Errorf("执行 Lua 脚本 '%s' 失败: %w", l.Name, err)
+	if err := l.lua.run(); err != nil {
+		return result, fmt.Errorf("执行 Lua 脚本 '%s' 失败: %w", l.Name, err)
 	}
-	return nil
+	return result, nil
 }
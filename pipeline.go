@@ -9,6 +9,12 @@ import (
 )
 
 // PipelineManager manages the collection of rendering layers and the main render loop.
+//
+// Layer types are currently limited to "BASE" and "TEMPORARY", composited via the
+// BlendMode/Opacity defined in lua_engine.go. Geometry mapping (set_pixel_xy/zones),
+// a Go-native Effect registry ("EFFECT" layers), a "STREAM" layer type fed by
+// external pixel pushers, and a lifecycle event bus (/api/events, /api/ws) are not
+// implemented yet.
 type PipelineManager struct {
 	// layers stores active RenderLayer objects, keyed by their Name.
 	layers sync.Map
@@ -26,6 +32,42 @@ type PipelineManager struct {
 	isRunning bool
 }
 
+// compositePixel blends one layer's (r, g, b) output for a single LED into the
+// shared (dstR, dstG, dstB) pixel according to mode and alpha (0.0-1.0), and
+// returns the new destination values. All values are on the 0-255 scale.
+func compositePixel(dstR, dstG, dstB, r, g, b, alpha float64, mode BlendMode) (float64, float64, float64) {
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(255, v))
+	}
+
+	switch mode {
+	case BlendBase, BlendOverwrite:
+		// BASE/OVERWRITE replace the destination outright; opacity does not apply.
+		return clamp(r), clamp(g), clamp(b)
+	case BlendAdd:
+		return clamp(dstR + r*alpha), clamp(dstG + g*alpha), clamp(dstB + b*alpha)
+	case BlendMultiply:
+		mr := dstR * (r / 255.0)
+		mg := dstG * (g / 255.0)
+		mb := dstB * (b / 255.0)
+		return clamp(dstR + (mr-dstR)*alpha), clamp(dstG + (mg-dstG)*alpha), clamp(dstB + (mb-dstB)*alpha)
+	case BlendScreen:
+		sr := 255.0 - (255.0-dstR)*(255.0-r)/255.0
+		sg := 255.0 - (255.0-dstG)*(255.0-g)/255.0
+		sb := 255.0 - (255.0-dstB)*(255.0-b)/255.0
+		return clamp(dstR + (sr-dstR)*alpha), clamp(dstG + (sg-dstG)*alpha), clamp(dstB + (sb-dstB)*alpha)
+	case BlendMax:
+		return clamp(dstR + (math.Max(dstR, r)-dstR)*alpha),
+			clamp(dstG + (math.Max(dstG, g)-dstG)*alpha),
+			clamp(dstB + (math.Max(dstB, b)-dstB)*alpha)
+	case BlendAlphaOver:
+		fallthrough
+	default:
+		// Unknown modes degrade gracefully to alpha-over rather than silently dropping the layer.
+		return clamp(dstR + (r-dstR)*alpha), clamp(dstG + (g-dstG)*alpha), clamp(dstB + (b-dstB)*alpha)
+	}
+}
+
 // fixColor applies a non-linear brightness correction and color bias to an RGB value.
 // It assumes inputs are 0-255 uint8 and returns corrected 0-255 uint8 values.
 func fixColor(colorR, colorG, colorB float64) (uint8, uint8, uint8) {
@@ -67,29 +109,33 @@ func (p *PipelineManager) AddLayer(layer RenderLayer) error {
 
 	switch layer.Type {
 	case "BASE":
-		layer.BlendMode = ModeBase
+		// The BASE layer always fully replaces the buffer; opacity would be meaningless.
+		layer.BlendMode = BlendBase
+		layer.Opacity = 1.0
 	case "TEMPORARY":
-		layer.BlendMode = ModeOverwrite
 		layer.AddedAt = time.Now()
+		if layer.BlendMode == "" {
+			layer.BlendMode = BlendOverwrite
+		}
+		// Opacity defaulting happens at the API layer (see layerRequest in api.go),
+		// since the zero value here is a legitimate, meaningful "fully transparent" request.
 	default:
 		return fmt.Errorf("未知 Layer Type: %s", layer.Type)
 	}
 
-	// Ensure only one BASE layer exists at a time.
-	if layer.Type == "BASE" {
-		p.layers.Range(func(key, value any) bool {
-			l := value.(RenderLayer)
-			if l.Type == "BASE" && l.Name != layer.Name {
-				p.layers.Delete(key)
-			}
-			return true
-		})
+	if !isValidBlendMode(layer.BlendMode) {
+		return fmt.Errorf("未知混合模式: %s", layer.BlendMode)
+	}
+	if layer.Opacity < 0.0 || layer.Opacity > 1.0 {
+		return fmt.Errorf("opacity 超出范围 [0.0, 1.0]: %v", layer.Opacity)
 	}
 
 	// If a layer with the same name already exists, update its creation time only if it's TEMPORARY,
 	// otherwise just update the layer struct, preserving the original AddedAt for PERSISTENT/BASE layers.
+	var oldLua *layerLuaState
 	if existing, ok := p.layers.Load(layer.Name); ok {
 		existingLayer := existing.(RenderLayer)
+		oldLua = existingLayer.lua
 		// Preserve original AddedAt unless it's a new TEMPORARY layer
 		if layer.Type != "TEMPORARY" {
 			layer.AddedAt = existingLayer.AddedAt
@@ -100,7 +146,28 @@ func (p *PipelineManager) AddLayer(layer RenderLayer) error {
 			layer.AddedAt = time.Now()
 		}
 	}
-	
+
+	// Compile the layer's script into a long-lived Lua state once here, instead of
+	// re-parsing it every frame. This must happen before any existing layer is
+	// touched below, so a bad script leaves the pipeline exactly as it was.
+	if err := layer.compileLua(); err != nil {
+		return err
+	}
+
+	// Ensure only one BASE layer exists at a time. Only done once compileLua has
+	// succeeded, so a failed replacement never leaves the pipeline without a BASE layer.
+	if layer.Type == "BASE" {
+		p.layers.Range(func(key, value any) bool {
+			l := value.(RenderLayer)
+			if l.Type == "BASE" && l.Name != layer.Name {
+				l.closeLua()
+				p.layers.Delete(key)
+			}
+			return true
+		})
+	}
+	oldLua.Close()
+
 	p.layers.Store(layer.Name, layer)
 	fmt.Printf("管线: 添加/更新层 '%s' (%s)\n", layer.Name, layer.Type)
 	return nil
@@ -111,9 +178,12 @@ func (p *PipelineManager) RemoveLayer(name string) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	if _, ok := p.layers.Load(name); !ok {
+	existing, ok := p.layers.Load(name)
+	if !ok {
 		return fmt.Errorf("层 '%s' 不存在", name)
 	}
+	layer := existing.(RenderLayer)
+	layer.closeLua()
 	p.layers.Delete(name)
 	fmt.Printf("管线: 删除层 '%s'\n", name)
 	return nil
@@ -155,6 +225,7 @@ func (p *PipelineManager) renderFrame() {
 			timeElapsed := currentTime - layer.AddedAt.Sub(p.startTime).Seconds()
 			if timeElapsed > layer.TimeoutSeconds && layer.TimeoutSeconds > 0 { // Check if TimeoutSeconds > 0 to prevent accidental removal
 				fmt.Printf("管线: 临时层 '%s' 超时，自动删除。\n", layer.Name)
+				layer.closeLua()
 				p.layers.Delete(key)
 				return true
 			}
@@ -182,16 +253,37 @@ func (p *PipelineManager) renderFrame() {
 		p.pixelBuffer[i] = 0
 	}
 
-	// 4. Execute layers in sorted order
+	// 4. Execute each layer into its own scratch buffer, then composite it onto
+	// p.pixelBuffer according to its blend mode and opacity. Layers only affect
+	// the LEDs they actually wrote via set_pixel (tracked by the written mask).
 	for _, layer := range activeLayers {
 		// Calculate the time elapsed since this specific layer was added
 		// This value will be exposed to Lua via get_layer_elapsed_time()
 		layerElapsedTime := currentTime - layer.AddedAt.Sub(p.startTime).Seconds()
 
 		// Pass both the total pipeline time (currentTime) and layer-specific elapsed time
-		if err := layer.execute(&p.pixelBuffer, currentTime, layerElapsedTime); err != nil {
+		result, err := layer.execute(p.pixelBuffer, currentTime, layerElapsedTime)
+		if err != nil {
 			// If a layer fails, log the error but continue rendering with other layers.
 			fmt.Printf("渲染错误 (%s): %v\n", layer.Name, err)
+			continue
+		}
+
+		for i := 0; i < LEDCount; i++ {
+			if !result.written[i] {
+				continue
+			}
+			alpha := result.alpha[i]
+			if alpha == unsetAlpha {
+				alpha = layer.Opacity
+			}
+
+			idx := i * 3
+			p.pixelBuffer[idx+0], p.pixelBuffer[idx+1], p.pixelBuffer[idx+2] = compositePixel(
+				p.pixelBuffer[idx+0], p.pixelBuffer[idx+1], p.pixelBuffer[idx+2],
+				result.buffer[idx+0], result.buffer[idx+1], result.buffer[idx+2],
+				alpha, result.blendMode,
+			)
 		}
 	}
 